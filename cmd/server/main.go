@@ -2,22 +2,34 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bugsnag/bugsnag-go/v2"
@@ -25,6 +37,11 @@ import (
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"golang.org/x/net/publicsuffix"
@@ -32,6 +49,14 @@ import (
 
 const upstream = "http://localhost:3000"
 
+// imageCache and layerCache are populated in main before the server starts
+// accepting requests. A nil cache (e.g. if the cache directory can't be
+// created) disables caching without failing the whole server.
+var (
+	imageCache *diskCache
+	layerCache *diskCache
+)
+
 func main() {
 	log.Printf("Commit %s\n", os.Getenv("VERSION"))
 
@@ -42,10 +67,26 @@ func main() {
 		})
 	}
 
+	if useStreamingImageWriter() {
+		log.Printf("warning: BUNDLE_STREAMING_IMAGE_WRITER is enabled; each concurrent image copy (up to BUNDLE_IMAGE_CONCURRENCY) buffers the full image in memory instead of writing to disk")
+	}
+
+	var err error
+	imageCache, err = newDiskCache(bundleCacheDir("images"), bundleCacheMaxBytes())
+	if err != nil {
+		log.Printf("warning: image cache disabled: %v", err)
+	}
+	layerCache, err = newDiskCache(bundleCacheDir("layers"), bundleCacheMaxBytes())
+	if err != nil {
+		log.Printf("warning: layer cache disabled: %v", err)
+	}
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/bundle/{installerID}", http.HandlerFunc(bundle))
 	r.HandleFunc("/bundle/version/{kurlVersion}/{installerID}", http.HandlerFunc(bundle))
+	r.HandleFunc("/cache/stats", http.HandlerFunc(cacheStats))
+	r.HandleFunc("/cache/purge", http.HandlerFunc(cachePurge))
 
 	upstreamURL, err := url.Parse(upstream)
 	if err != nil {
@@ -66,13 +107,195 @@ func main() {
 type BundleManifest struct {
 	Layers []string          `json:"layers"`
 	Files  map[string]string `json:"files"`
-	Images []string          `json:"images"`
+	Images []ImageRef        `json:"images"`
+	// Platforms fans an image entry out into one copy per platform when the
+	// entry itself does not pin a single platform, e.g. ["linux/amd64", "linux/arm64"].
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// ImageRef identifies a single image to embed in the bundle. It unmarshals
+// from either a bare string (the historical "registry/repo:tag" form) or an
+// object for callers that need to pin a digest, mediaType, or platform.
+type ImageRef struct {
+	Ref string `json:"ref"`
+	// Platform pins this entry to a single platform, e.g. "linux/arm64". When
+	// empty, BundleManifest.Platforms (if any) is used to fan this image out
+	// across multiple platforms.
+	Platform string `json:"platform,omitempty"`
+	// Digest pins the manifest digest to copy, e.g. "sha256:abcd...". It is
+	// appended to Ref (as "ref@digest") when Ref does not already carry one.
+	Digest string `json:"digest,omitempty"`
+	// MediaType is recorded for callers that want to assert the expected
+	// manifest type; containers/image negotiates the transport media type
+	// itself, so this is informational only.
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// UnmarshalJSON accepts both the plain string form ("repo/image:tag") and
+// the object form ({"ref": "...", "platform": "...", ...}).
+func (i *ImageRef) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err == nil {
+		i.Ref = ref
+		return nil
+	}
+
+	type imageRefAlias ImageRef
+	var alias imageRefAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	*i = ImageRef(alias)
+	return nil
+}
+
+// String returns the image reference with Digest appended, if set and not
+// already present in Ref, e.g. "repo/image@sha256:abcd...".
+func (i ImageRef) String() string {
+	if i.Digest == "" || strings.Contains(i.Ref, "@") {
+		return i.Ref
+	}
+	if strings.Contains(i.Digest, ":") {
+		return i.Ref + "@" + i.Digest
+	}
+	return i.Ref + "@sha256:" + i.Digest
 }
 
 var imagePolicy = []byte(`{
 	"default": [{"type": "insecureAcceptAnything"}]
 }`)
 
+// registryAuthEntry mirrors the Docker Engine AuthConfig payload sent in the
+// X-Registry-Auth header, e.g. what `docker push`/`docker login` produce.
+type registryAuthEntry struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+	ServerAddress string `json:"serveraddress"`
+}
+
+// parseRegistryAuth decodes the X-Registry-Auth header into a map of
+// registry hostname to credentials. The header may be:
+//   - a single base64-url-encoded AuthConfig JSON object with a
+//     "serveraddress" field (the `docker login`/push convention)
+//   - a comma-separated list of such encoded entries
+//   - a base64-url-encoded JSON object keyed by registry host, matching the
+//     "auths" map in ~/.docker/config.json
+//
+// Entries that fail to decode are skipped rather than failing the request,
+// since a malformed credential for one registry shouldn't block a bundle
+// that doesn't need it.
+func parseRegistryAuth(header string) map[string]registryAuthEntry {
+	auths := map[string]registryAuthEntry{}
+	if header == "" {
+		return auths
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		decoded, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(part)
+		if err != nil {
+			decoded, err = base64.URLEncoding.DecodeString(part)
+		}
+		if err != nil {
+			continue
+		}
+
+		var byHost map[string]registryAuthEntry
+		if err := json.Unmarshal(decoded, &byHost); err == nil && len(byHost) > 0 {
+			for host, entry := range byHost {
+				auths[normalizeRegistryHost(host)] = entry
+			}
+			continue
+		}
+
+		var entry registryAuthEntry
+		if err := json.Unmarshal(decoded, &entry); err == nil && entry.ServerAddress != "" {
+			auths[normalizeRegistryHost(entry.ServerAddress)] = entry
+		}
+	}
+
+	return auths
+}
+
+// registryAuthEntry2DockerAuthConfig converts a registryAuthEntry for the
+// legacy containers/image copy path. RegistryToken is dropped here:
+// types.DockerAuthConfig has no equivalent field, so bearer/registry-token
+// auth only works through the go-containerregistry streaming path (see
+// authnForImage), not through containers/image.
+func registryAuthEntry2DockerAuthConfig(entry registryAuthEntry) types.DockerAuthConfig {
+	return types.DockerAuthConfig{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+	}
+}
+
+// normalizeRegistryHost strips a leading scheme and any path from a registry
+// address so it can be compared against an image's hostname, e.g.
+// "https://index.docker.io/v1/" -> "index.docker.io".
+func normalizeRegistryHost(serverAddress string) string {
+	host := serverAddress
+	if idx := strings.Index(host, "://"); idx != -1 {
+		host = host[idx+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	return host
+}
+
+// registryHostForImage returns the registry hostname for an image reference,
+// mirroring how Docker's own reference parsing tells a registry host apart
+// from a repository namespace: the part before the first "/" is only a host
+// when it looks like one (contains a "." or ":", or is exactly "localhost").
+// Otherwise the reference is an unqualified Docker Hub repository, e.g.
+// "myorg/myimage:tag" or "ubuntu:latest", and the host defaults to
+// "docker.io".
+func registryHostForImage(image string) string {
+	first := image
+	if idx := strings.Index(first, "/"); idx != -1 {
+		first = first[:idx]
+	} else {
+		return "docker.io"
+	}
+	if first == "localhost" || strings.ContainsAny(first, ".:") {
+		return first
+	}
+	return "docker.io"
+}
+
+// registryAuthConfigForImage looks up the registry auth entry matching an
+// image reference's registry host, falling back to the docker.io/
+// index.docker.io alias before reporting no match.
+func registryAuthConfigForImage(auths map[string]registryAuthEntry, image string) (registryAuthEntry, bool) {
+	host := registryHostForImage(image)
+	if auth, ok := auths[host]; ok {
+		return auth, true
+	}
+	// docker.io images are commonly referenced without a hostname, but auth
+	// entries follow docker's convention of keying on index.docker.io.
+	if host == "docker.io" {
+		if auth, ok := auths["index.docker.io"]; ok {
+			return auth, true
+		}
+	}
+	return registryAuthEntry{}, false
+}
+
+// authConfigForImage looks up the registry auth entry matching an image
+// reference's hostname, falling back to anonymous access when no entry
+// matches. See registryAuthEntry2DockerAuthConfig for the RegistryToken
+// caveat.
+func authConfigForImage(auths map[string]registryAuthEntry, image string) *types.DockerAuthConfig {
+	entry, _ := registryAuthConfigForImage(auths, image)
+	cfg := registryAuthEntry2DockerAuthConfig(entry)
+	return &cfg
+}
+
 func bundle(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "OPTIONS" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -153,24 +376,62 @@ func bundle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, image := range bundle.Images {
-		if !allowRegistry(image) {
-			err := errors.Errorf("Unsupported image registry %s", image)
+		if !allowRegistry(image.String()) {
+			err := errors.Errorf("Unsupported image registry %s", image.String())
 			handleHttpError(w, r, err, http.StatusUnprocessableEntity)
 			return
 		}
 	}
 
-	w.Header().Set("Content-Type", "binary/octet-stream")
+	registryAuths := parseRegistryAuth(r.Header.Get("X-Registry-Auth"))
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Disposition", "attachment")
 	w.Header().Set("Transfer-Encoding", "chunked")
 
+	var progress *progressReporter
+	var mw *multipart.Writer
+	var spool *os.File
+	archiveOut := io.Writer(w)
+
+	if wantsProgress(r) {
+		mw = multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+		progressPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/x-ndjson"}})
+		if err != nil {
+			err = errors.Wrap(err, "error creating progress stream part")
+			handleHttpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		progress = newProgressReporter(progressPart)
+
+		// The archive part can't be opened yet: mw.CreatePart finalizes the
+		// previous part as soon as the next one is created, and progress
+		// events are emitted throughout the image/layer processing below, so
+		// progressPart has to stay open for the rest of the handler. Spool
+		// the archive to a temp file instead and open the archive part only
+		// once every progress event has been written, just before mw.Close.
+		spool, err = ioutil.TempFile("", "bundle-archive-*.tar.gz")
+		if err != nil {
+			err = errors.Wrap(err, "error creating archive spool file")
+			handleHttpError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		archiveOut = spool
+	} else {
+		w.Header().Set("Content-Type", "binary/octet-stream")
+	}
+
 	if r.Method == "HEAD" {
 		return
 	}
 
-	wz := gzip.NewWriter(w)
+	wz := gzip.NewWriter(archiveOut)
 	archive := tar.NewWriter(wz)
+	var requestFailed bool
 	defer func() {
 		// TODO: it would be better to somehow make this archive invalid if there is an error so
 		// it's not just missing a package
@@ -183,101 +444,91 @@ func bundle(w http.ResponseWriter, r *http.Request) {
 			err = errors.Wrapf(err, "error closing gzip stream for installer %s", installerID)
 			handleError(r.Context(), err)
 		}
+
+		if mw != nil {
+			// If the request already failed, the failure was reported through
+			// progress's Error field (see the firstErr handling below): once
+			// the progress part has started writing to w, a plaintext
+			// handleHttpError body can't be delivered anyway, and creating the
+			// archive part here would just append a bogus/truncated one after
+			// it. Skip straight to closing the multipart writer.
+			if spool != nil && !requestFailed {
+				if _, err := spool.Seek(0, io.SeekStart); err != nil {
+					err = errors.Wrapf(err, "error rewinding archive spool for installer %s", installerID)
+					handleError(r.Context(), err)
+				} else if archivePart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/gzip"}}); err != nil {
+					err = errors.Wrapf(err, "error creating archive part for installer %s", installerID)
+					handleError(r.Context(), err)
+				} else if _, err := io.Copy(archivePart, spool); err != nil {
+					err = errors.Wrapf(err, "error copying archive into response for installer %s", installerID)
+					handleError(r.Context(), err)
+				}
+			}
+
+			if err := mw.Close(); err != nil {
+				err = errors.Wrapf(err, "error closing multipart response for installer %s", installerID)
+				handleError(r.Context(), err)
+			}
+		}
 	}()
 
+	var jobs []imageCopyJob
 	for i, image := range bundle.Images {
-		srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", image))
-		if err != nil {
-			err = errors.Wrapf(err, "error parsing override image %q: %v", image, err)
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
+		imageStr := image.String()
+		for _, platform := range platformsForImage(image, bundle.Platforms) {
+			jobs = append(jobs, imageCopyJob{idx: i, imageStr: imageStr, platform: platform})
 		}
+	}
 
-		tempDir, err := ioutil.TempDir("/images", "temp-image-pull")
-		if err != nil {
-			err = errors.Wrap(err, "error creating temp directory")
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
-		defer os.RemoveAll(tempDir)
+	copyCtx, cancelCopies := context.WithCancel(r.Context())
+	defer cancelCopies()
 
-		destPath := path.Join(tempDir, "temp-archive-image")
-		destStr := fmt.Sprintf("docker-archive:%s:%s", destPath, image)
-		localRef, err := alltransports.ParseImageName(destStr)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to parse local image name: %s", destStr)
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
+	concurrency := bundleImageConcurrency()
+	diskReserve := bundleImageDiskReserveBytes()
+	streaming := useStreamingImageWriter()
 
-		policy, err := signature.NewPolicyFromBytes(imagePolicy)
-		if err != nil {
-			err = errors.Wrap(err, "failed to read default image policy")
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
-		policyContext, err := signature.NewPolicyContext(policy)
-		if err != nil {
-			err = errors.Wrap(err, "failed to create image policy context")
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
-		destCtx := &types.SystemContext{
-			DockerDisableV1Ping: true,
-		}
-		srcCtx := &types.SystemContext{
-			DockerDisableV1Ping: true,
-			AuthFilePath:        "/dev/null",
-			DockerAuthConfig: &types.DockerAuthConfig{
-				Username:      "",
-				Password:      "",
-				IdentityToken: "",
-			},
-		}
-		_, err = copy.Image(r.Context(), policyContext, localRef, srcRef, &copy.Options{
-			RemoveSignatures:      true,
-			SignBy:                "",
-			ForceManifestMIMEType: "",
-			DestinationCtx:        destCtx,
-			SourceCtx:             srcCtx,
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var archiveMu sync.Mutex
+	var errOnce sync.Once
+	var firstErr error
+	recordErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancelCopies()
 		})
-		if err != nil {
-			err = errors.Wrapf(err, "failed to save docker image archive of %s", image)
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
+	}
 
-		f, err := os.Open(destPath)
-		if err != nil {
-			err = errors.Wrap(err, "failed to open override image archive")
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
-		fi, err := f.Stat()
-		if err != nil {
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
+	for _, job := range jobs {
+		job := job
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-		header := &tar.Header{
-			Name:    fmt.Sprintf("kurl/image-overrides/%d.tar", i),
-			Size:    fi.Size(),
-			Mode:    0644,
-			ModTime: time.Now(),
-		}
-		archive.WriteHeader(header)
-		_, err = io.Copy(archive, f)
-		if err != nil {
-			err = errors.Wrapf(err, "copy file %s contents", header.Name)
-			handleHttpError(w, r, err, http.StatusInternalServerError)
-			return
+			if err := runImageCopyJob(copyCtx, archive, &archiveMu, job, registryAuths, progress, streaming, diskReserve, imageCache); err != nil {
+				recordErr(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		requestFailed = true
+		if mw != nil {
+			// Streaming has already started: the progress part is the only
+			// channel left to report an error through, since a plaintext
+			// handleHttpError body can't be interleaved with it.
+			progress.emit(progressEvent{Status: "Bundling images", Error: firstErr.Error()})
+		} else {
+			handleHttpError(w, r, firstErr, http.StatusInternalServerError)
 		}
-		os.RemoveAll(tempDir)
-		runtime.GC()
+		return
 	}
 
 	for _, layerURL := range bundle.Layers {
-		if err := pipe(archive, layerURL); err != nil {
+		if err := pipe(archive, layerURL, progress, layerCache); err != nil {
 			err = errors.Wrapf(err, "error piping %s to %s bundle", layerURL, installerID)
 			handleError(r.Context(), err)
 			return
@@ -300,39 +551,218 @@ func bundle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func pipe(dst *tar.Writer, srcURL string) error {
-	resp, err := http.Get(srcURL)
+// pipe downloads the tar.gz at srcURL, re-roots each entry under "kurl/",
+// and writes it into dst. When cache is set, it's consulted first: a prior
+// download is revalidated with a conditional GET (If-None-Match /
+// If-Modified-Since against the stored ETag/Last-Modified), and on a 304 the
+// already-renamed entries are replayed from the cached copy instead of
+// re-downloading and re-processing the source tar.gz.
+func pipe(dst *tar.Writer, srcURL string, progress *progressReporter, cache *diskCache) error {
+	cacheKey := "layer-" + sanitizeCacheKey(sha256Hex(srcURL))
+
+	var condEtag, condLastModified string
+	if cache != nil {
+		if entry, ok := cache.Peek(cacheKey); ok {
+			condEtag = entry.etag
+			condLastModified = entry.lastModified
+		}
+	}
+
+	progress.emit(progressEvent{Status: "Downloading", ID: srcURL})
+
+	req, err := http.NewRequest("GET", srcURL, nil)
 	if err != nil {
+		progress.emit(progressEvent{Status: "Downloading", ID: srcURL, Error: err.Error()})
+		return err
+	}
+	if condEtag != "" {
+		req.Header.Set("If-None-Match", condEtag)
+	}
+	if condLastModified != "" {
+		req.Header.Set("If-Modified-Since", condLastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		progress.emit(progressEvent{Status: "Downloading", ID: srcURL, Error: err.Error()})
 		return err
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cache != nil {
+		entry, rc, err := cache.Get(cacheKey)
+		if err != nil {
+			progress.emit(progressEvent{Status: "Downloading", ID: srcURL, Error: err.Error()})
+			return err
+		}
+		if rc != nil {
+			defer rc.Close()
+			progress.emit(progressEvent{Status: "Using cached layer", ID: srcURL, ProgressDetail: &progressDetail{Total: entry.size}})
+			if err := replayCachedLayer(dst, rc); err != nil {
+				return err
+			}
+			progress.emit(progressEvent{Status: "Download complete", ID: srcURL})
+			return nil
+		}
+		// Server says unchanged but we have nothing cached for it (e.g. it
+		// was evicted between the conditional headers being built and the
+		// response); fall through to the status check below, which rejects
+		// the 304 as an unexpected response code.
+	}
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("unexpected response code %d", resp.StatusCode)
+		err := errors.Errorf("unexpected response code %d", resp.StatusCode)
+		progress.emit(progressEvent{Status: "Downloading", ID: srcURL, Error: err.Error()})
+		return err
 	}
 
 	zr, err := gzip.NewReader(resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "gunzip response")
+		err = errors.Wrap(err, "gunzip response")
+		progress.emit(progressEvent{Status: "Downloading", ID: srcURL, Error: err.Error()})
+		return err
 	}
 	defer zr.Close()
 	src := tar.NewReader(zr)
 
+	var cacheBuf bytes.Buffer
+	var cacheTar *tar.Writer
+	if cache != nil {
+		cacheTar = tar.NewWriter(&cacheBuf)
+	}
+
 	for {
 		header, err := src.Next()
 		if err == io.EOF {
+			if cacheTar != nil {
+				if err := cacheTar.Close(); err != nil {
+					log.Printf("warning: failed to finalize layer cache entry for %s: %v", srcURL, err)
+				} else if _, err := cache.Put(cacheKey, &cacheBuf, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")); err != nil {
+					log.Printf("warning: failed to populate layer cache for %s: %v", srcURL, err)
+				}
+			}
+			progress.emit(progressEvent{Status: "Download complete", ID: srcURL})
 			return nil
 		} else if err != nil {
 			return errors.Wrap(err, "next file")
 		}
 		header.Name = filepath.Join("kurl", header.Name)
 		dst.WriteHeader(header)
-		_, err = io.Copy(dst, src)
+
+		w := io.Writer(dst)
+		if cacheTar != nil {
+			cacheTar.WriteHeader(header)
+			w = io.MultiWriter(dst, cacheTar)
+		}
+		_, err = io.Copy(w, src)
 		if err != nil {
 			return errors.Wrapf(err, "copy file %s contents", header.Name)
 		}
 	}
 }
 
+// replayCachedLayer writes the already kurl/-rooted tar entries cached by
+// pipe directly into dst, skipping the network fetch and gunzip/retar work.
+func replayCachedLayer(dst *tar.Writer, r io.Reader) error {
+	src := tar.NewReader(r)
+	for {
+		header, err := src.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "next cached file")
+		}
+		dst.WriteHeader(header)
+		if _, err := io.Copy(dst, src); err != nil {
+			return errors.Wrapf(err, "copy cached file %s contents", header.Name)
+		}
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// progressEvent models a single line of the Docker Engine pull/push JSON
+// stream (https://docs.docker.com/engine/api/v1.41/#tag/Image/operation/ImageCreate)
+// so existing client libraries that already render `docker pull` progress
+// bars can be reused against kURL bundle downloads.
+type progressEvent struct {
+	Status         string          `json:"status"`
+	ProgressDetail *progressDetail `json:"progressDetail,omitempty"`
+	ID             string          `json:"id,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// progressReporter serializes progressEvents as NDJSON onto an underlying
+// writer. A nil *progressReporter is valid and turns every method into a
+// no-op, so progress reporting can be threaded through unconditionally and
+// only materializes when a client opts in.
+type progressReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newProgressReporter(w io.Writer) *progressReporter {
+	return &progressReporter{enc: json.NewEncoder(w)}
+}
+
+func (p *progressReporter) emit(ev progressEvent) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Errors writing progress are not fatal to the bundle itself; the
+	// client may simply have gone away.
+	_ = p.enc.Encode(ev)
+}
+
+// imageWriter returns an io.Writer suitable for copy.Options.ReportWriter:
+// containers/image writes human-readable lines like "Copying blob
+// sha256:...done" to it, which are forwarded as synthetic status events
+// keyed by the image reference.
+func (p *progressReporter) imageWriter(image string) io.Writer {
+	return &imageProgressWriter{reporter: p, id: image}
+}
+
+type imageProgressWriter struct {
+	reporter *progressReporter
+	id       string
+}
+
+func (w *imageProgressWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		w.reporter.emit(progressEvent{Status: line, ID: w.id})
+	}
+	return len(b), nil
+}
+
+// wantsProgress reports whether the client opted in to the NDJSON progress
+// stream, via `Accept: application/x-ndjson` or `?progress=1`.
+func wantsProgress(r *http.Request) bool {
+	if r.URL.Query().Get("progress") == "1" {
+		return true
+	}
+	for _, accept := range r.Header["Accept"] {
+		for _, part := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) == "application/x-ndjson" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func handleHttpError(w http.ResponseWriter, r *http.Request, err error, code int) {
 	log.Println(err)
 	http.Error(w, http.StatusText(code), code)
@@ -344,6 +774,717 @@ func handleError(ctx context.Context, err error) {
 	bugsnag.Notify(err, ctx)
 }
 
+// platformsForImage returns the platforms to copy for an image entry: the
+// entry's own pinned Platform if set, otherwise the bundle-wide Platforms
+// list to fan out across, otherwise a single empty platform meaning "let
+// the registry/daemon pick its default".
+func platformsForImage(image ImageRef, bundlePlatforms []string) []string {
+	if image.Platform != "" {
+		return []string{image.Platform}
+	}
+	if len(bundlePlatforms) > 0 {
+		return bundlePlatforms
+	}
+	return []string{""}
+}
+
+// parsePlatform splits a platform string of the form "os/arch" or
+// "os/arch/variant" (following the OCI image-spec convention used by
+// `docker buildx` and `docker pull --platform`) into its components.
+func parsePlatform(platform string) (os, arch, variant string, err error) {
+	parts := strings.Split(platform, "/")
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], "", nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	default:
+		return "", "", "", errors.Errorf("expected platform in os/arch[/variant] form, got %q", platform)
+	}
+}
+
+// imageOverrideName returns the tar entry name for an image-overrides
+// archive. Images copied for a single, unspecified platform keep the
+// original "<idx>.tar" naming for backwards compatibility; images copied
+// for a specific platform (whether pinned per-entry or fanned out from
+// bundle.Platforms) get a "<idx>-<os>-<arch>.tar" name, or
+// "<idx>-<os>-<arch>-<variant>.tar" when the platform has a variant, so
+// multiple platforms of the same image don't collide. A platform that
+// doesn't parse as os/arch[/variant] falls back to "<idx>.tar".
+func imageOverrideName(idx int, platform string) string {
+	if platform == "" {
+		return fmt.Sprintf("kurl/image-overrides/%d.tar", idx)
+	}
+	os, arch, variant, err := parsePlatform(platform)
+	if err != nil {
+		return fmt.Sprintf("kurl/image-overrides/%d.tar", idx)
+	}
+	if variant != "" {
+		return fmt.Sprintf("kurl/image-overrides/%d-%s-%s-%s.tar", idx, os, arch, variant)
+	}
+	return fmt.Sprintf("kurl/image-overrides/%d-%s-%s.tar", idx, os, arch)
+}
+
+// imageCopyJob is a single (image, platform) pair to copy into the bundle's
+// image-overrides. An image without a pinned platform and without
+// bundle-wide platforms to fan out across yields exactly one job with an
+// empty platform.
+type imageCopyJob struct {
+	idx      int
+	imageStr string
+	platform string
+}
+
+const (
+	defaultBundleImageConcurrency      = 4
+	defaultBundleImageDiskReserveBytes = 1 << 30 // 1GiB
+)
+
+// bundleImageConcurrency returns the number of images to copy in parallel,
+// configurable via BUNDLE_IMAGE_CONCURRENCY since installers with dozens of
+// images make strictly sequential copying painfully slow.
+func bundleImageConcurrency() int {
+	if v := os.Getenv("BUNDLE_IMAGE_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultBundleImageConcurrency
+}
+
+// bundleImageDiskReserveBytes returns the minimum free space that must
+// remain available under /images before scheduling another image copy,
+// configurable via BUNDLE_IMAGE_DISK_RESERVE_BYTES.
+func bundleImageDiskReserveBytes() uint64 {
+	if v := os.Getenv("BUNDLE_IMAGE_DISK_RESERVE_BYTES"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return defaultBundleImageDiskReserveBytes
+}
+
+const defaultBundleCacheMaxBytes = 20 << 30 // 20GiB
+
+// bundleCacheDir returns the on-disk directory for a given cache (e.g.
+// "images" or "layers"), rooted at BUNDLE_CACHE_DIR (default "/images/cache").
+func bundleCacheDir(name string) string {
+	root := os.Getenv("BUNDLE_CACHE_DIR")
+	if root == "" {
+		root = "/images/cache"
+	}
+	return filepath.Join(root, name)
+}
+
+// bundleCacheMaxBytes returns the maximum total size, in bytes, a single
+// cache is allowed to grow to before its LRU eviction kicks in, configurable
+// via BUNDLE_CACHE_MAX_BYTES.
+func bundleCacheMaxBytes() int64 {
+	if v := os.Getenv("BUNDLE_CACHE_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultBundleCacheMaxBytes
+}
+
+// cacheEntry is the in-memory record for one cached blob. The blob itself
+// lives at <dir>/<key>.blob; etag/lastModified (when present) are persisted
+// alongside it at <dir>/<key>.meta.json so conditional revalidation survives
+// a restart.
+type cacheEntry struct {
+	key          string
+	size         int64
+	etag         string
+	lastModified string
+}
+
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// diskCache is a persistent on-disk cache with byte-budgeted LRU eviction.
+// It backs both the image-copy cache (keyed by resolved manifest digest) and
+// the Airgap layer cache (keyed by a hash of the source URL alone; the
+// ETag/Last-Modified validators are stored with the entry for conditional
+// revalidation and are not part of the key), so two otherwise-identical bundle requests don't each
+// redownload and reassemble images and layers that haven't changed upstream.
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	total    int64
+	lru      *list.List // front = least recently used, back = most recently used
+	index    map[string]*list.Element
+}
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "error creating cache directory %s", dir)
+	}
+
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		index:    map[string]*list.Element{},
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *diskCache) blobPath(key string) string { return filepath.Join(c.dir, key+".blob") }
+func (c *diskCache) metaPath(key string) string { return filepath.Join(c.dir, key+".meta.json") }
+
+// reload rebuilds the in-memory LRU index from the blobs already on disk,
+// ordering them oldest-modified-first as an approximation of LRU order
+// across restarts.
+func (c *diskCache) reload() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return errors.Wrapf(err, "error listing cache directory %s", c.dir)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".blob") {
+			continue
+		}
+		key := strings.TrimSuffix(fi.Name(), ".blob")
+		entry := &cacheEntry{key: key, size: fi.Size()}
+		if raw, err := ioutil.ReadFile(c.metaPath(key)); err == nil {
+			var meta cacheMeta
+			if json.Unmarshal(raw, &meta) == nil {
+				entry.etag = meta.ETag
+				entry.lastModified = meta.LastModified
+			}
+		}
+		c.index[key] = c.lru.PushBack(entry)
+		c.total += entry.size
+	}
+	return nil
+}
+
+// Get returns the cached entry and an open reader for key, or a nil reader
+// if there is no cache hit. The caller must close the reader.
+func (c *diskCache) Get(key string) (*cacheEntry, io.ReadCloser, error) {
+	c.mu.Lock()
+	el, ok := c.index[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil, nil
+	}
+	c.lru.MoveToBack(el)
+	entry := *el.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	f, err := os.Open(c.blobPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Wrapf(err, "error opening cache entry %s", key)
+	}
+	return &entry, f, nil
+}
+
+// Peek returns the cached validators for key without opening the blob, for
+// building a conditional request's If-None-Match/If-Modified-Since headers.
+// It does not affect LRU order, since it's not a use of the cached bytes.
+func (c *diskCache) Peek(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	entry := *el.Value.(*cacheEntry)
+	return &entry, true
+}
+
+// Put stores r under key, replacing any existing entry, and evicts
+// least-recently-used entries until the cache is back under its byte budget.
+func (c *diskCache) Put(key string, r io.Reader, etag, lastModified string) (int64, error) {
+	tmp, err := ioutil.TempFile(c.dir, "tmp-*")
+	if err != nil {
+		return 0, errors.Wrap(err, "error creating cache temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	closeErr := tmp.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "error writing cache entry")
+	}
+	if closeErr != nil {
+		return 0, errors.Wrap(closeErr, "error finalizing cache entry")
+	}
+
+	if err := os.Rename(tmp.Name(), c.blobPath(key)); err != nil {
+		return 0, errors.Wrap(err, "error finalizing cache entry")
+	}
+
+	if etag != "" || lastModified != "" {
+		meta, _ := json.Marshal(cacheMeta{ETag: etag, LastModified: lastModified})
+		_ = ioutil.WriteFile(c.metaPath(key), meta, 0644)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[key]; ok {
+		c.total -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+	}
+	entry := &cacheEntry{key: key, size: size, etag: etag, lastModified: lastModified}
+	c.index[key] = c.lru.PushBack(entry)
+	c.total += size
+	c.evictLocked()
+
+	return size, nil
+}
+
+func (c *diskCache) evictLocked() {
+	for c.total > c.maxBytes && c.lru.Len() > 0 {
+		front := c.lru.Front()
+		entry := front.Value.(*cacheEntry)
+		c.lru.Remove(front)
+		delete(c.index, entry.key)
+		c.total -= entry.size
+		os.Remove(c.blobPath(entry.key))
+		os.Remove(c.metaPath(entry.key))
+	}
+}
+
+type diskCacheStats struct {
+	Entries    int   `json:"entries"`
+	TotalBytes int64 `json:"totalBytes"`
+	MaxBytes   int64 `json:"maxBytes"`
+}
+
+func (c *diskCache) Stats() diskCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return diskCacheStats{Entries: len(c.index), TotalBytes: c.total, MaxBytes: c.maxBytes}
+}
+
+// Purge empties the cache, both on disk and in memory.
+func (c *diskCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.index {
+		os.Remove(c.blobPath(key))
+		os.Remove(c.metaPath(key))
+	}
+	c.index = map[string]*list.Element{}
+	c.lru = list.New()
+	c.total = 0
+}
+
+// sanitizeCacheKey makes a string safe to use as a filename component, e.g.
+// turning a digest "sha256:abcd..." into "sha256-abcd...".
+func sanitizeCacheKey(s string) string {
+	return strings.NewReplacer(":", "-", "/", "_").Replace(s)
+}
+
+type cacheStatsResponse struct {
+	Images diskCacheStats `json:"images"`
+	Layers diskCacheStats `json:"layers"`
+}
+
+func cacheStats(w http.ResponseWriter, r *http.Request) {
+	if !requireCacheAdminToken(w, r) {
+		return
+	}
+	resp := cacheStatsResponse{}
+	if imageCache != nil {
+		resp.Images = imageCache.Stats()
+	}
+	if layerCache != nil {
+		resp.Layers = layerCache.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		handleHttpError(w, r, errors.Wrap(err, "error encoding cache stats"), http.StatusInternalServerError)
+	}
+}
+
+// bundleCacheAdminToken is the shared secret required to call the cache
+// admin routes, configured via BUNDLE_CACHE_ADMIN_TOKEN. An empty token
+// disables the routes entirely rather than leaving them open to anonymous
+// callers by default.
+func bundleCacheAdminToken() string {
+	return os.Getenv("BUNDLE_CACHE_ADMIN_TOKEN")
+}
+
+// requireCacheAdminToken checks the request's X-Admin-Token header against
+// bundleCacheAdminToken, writing an error response and returning false on a
+// mismatch. Purging the cache forces every subsequent bundle request back
+// onto full registry/layer re-downloads, so it must not be reachable by
+// arbitrary callers.
+func requireCacheAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	token := bundleCacheAdminToken()
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func cachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireCacheAdminToken(w, r) {
+		return
+	}
+	if imageCache != nil {
+		imageCache.Purge()
+	}
+	if layerCache != nil {
+		layerCache.Purge()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// freeDiskBytes returns the bytes available to an unprivileged user on the
+// filesystem mounted at dir.
+func freeDiskBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// waitForDiskSpace blocks until at least reserve bytes are free under dir,
+// polling periodically, since parallel docker-archive writes can otherwise
+// exhaust the volume out from under a copy that's already in flight. It
+// gives up once ctx is done or a fixed wait budget elapses.
+func waitForDiskSpace(ctx context.Context, dir string, reserve uint64) error {
+	const pollInterval = 500 * time.Millisecond
+	const maxWait = 30 * time.Second
+
+	deadline := time.Now().Add(maxWait)
+	for {
+		free, err := freeDiskBytes(dir)
+		if err != nil {
+			return errors.Wrapf(err, "error checking free disk space under %s", dir)
+		}
+		if free >= reserve {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("insufficient disk space under %s: %d bytes free, need %d byte reserve", dir, free, reserve)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// copyImageToTempDir pulls job's image (and platform, if pinned) into a
+// fresh per-job temp dir under /images as a docker-archive, returning the
+// temp dir and the archive file path within it. The caller is responsible
+// for removing tempDir once it's done reading destPath.
+func copyImageToTempDir(ctx context.Context, job imageCopyJob, registryAuths map[string]registryAuthEntry, progress *progressReporter) (tempDir, destPath string, err error) {
+	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", job.imageStr))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error parsing override image %q: %v", job.imageStr, err)
+	}
+
+	tempDir, err = ioutil.TempDir("/images", "temp-image-pull")
+	if err != nil {
+		return "", "", errors.Wrap(err, "error creating temp directory")
+	}
+
+	destPath = path.Join(tempDir, "temp-archive-image")
+	destStr := fmt.Sprintf("docker-archive:%s:%s", destPath, job.imageStr)
+	localRef, err := alltransports.ParseImageName(destStr)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", errors.Wrapf(err, "failed to parse local image name: %s", destStr)
+	}
+
+	policy, err := signature.NewPolicyFromBytes(imagePolicy)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", errors.Wrap(err, "failed to read default image policy")
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", errors.Wrap(err, "failed to create image policy context")
+	}
+	destCtx := &types.SystemContext{
+		DockerDisableV1Ping: true,
+	}
+	srcCtx := &types.SystemContext{
+		DockerDisableV1Ping: true,
+		AuthFilePath:        "/dev/null",
+		DockerAuthConfig:    authConfigForImage(registryAuths, job.imageStr),
+	}
+	if job.platform != "" {
+		platformOS, arch, variant, err := parsePlatform(job.platform)
+		if err != nil {
+			os.RemoveAll(tempDir)
+			return "", "", errors.Wrapf(err, "error parsing platform %q for image %s", job.platform, job.imageStr)
+		}
+		srcCtx.OSChoice = platformOS
+		srcCtx.ArchitectureChoice = arch
+		srcCtx.VariantChoice = variant
+	}
+
+	progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr})
+	_, err = copy.Image(ctx, policyContext, localRef, srcRef, &copy.Options{
+		RemoveSignatures:      true,
+		SignBy:                "",
+		ForceManifestMIMEType: "",
+		DestinationCtx:        destCtx,
+		SourceCtx:             srcCtx,
+		ReportWriter:          progress.imageWriter(job.imageStr),
+	})
+	if err != nil {
+		os.RemoveAll(tempDir)
+		progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr, Error: err.Error()})
+		return "", "", errors.Wrapf(err, "failed to save docker image archive of %s", job.imageStr)
+	}
+	progress.emit(progressEvent{Status: "Pull complete", ID: job.imageStr})
+
+	return tempDir, destPath, nil
+}
+
+// writeReaderToArchive writes r (exactly size bytes) as a single entry into
+// archive under a mutex, since archive is shared across concurrent image
+// copies and a tar stream can only be appended to by one writer at a time.
+func writeReaderToArchive(archive *tar.Writer, archiveMu *sync.Mutex, r io.Reader, size int64, job imageCopyJob) error {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	header := &tar.Header{
+		Name:    imageOverrideName(job.idx, job.platform),
+		Size:    size,
+		Mode:    0644,
+		ModTime: time.Now(),
+	}
+	archive.WriteHeader(header)
+	if _, err := io.Copy(archive, r); err != nil {
+		return errors.Wrapf(err, "copy file %s contents", header.Name)
+	}
+	return nil
+}
+
+// writeImageOverrideToArchive appends the docker-archive at destPath to the
+// outer tar, populating cache under cacheKey along the way (when non-empty).
+// tempDir is always removed before returning.
+func writeImageOverrideToArchive(archive *tar.Writer, archiveMu *sync.Mutex, tempDir, destPath string, job imageCopyJob, cache *diskCache, cacheKey string) error {
+	defer os.RemoveAll(tempDir)
+
+	f, err := os.Open(destPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open override image archive")
+	}
+	defer f.Close()
+
+	if cache != nil && cacheKey != "" {
+		if _, err := cache.Put(cacheKey, f, "", ""); err != nil {
+			log.Printf("warning: failed to populate image cache for %s: %v", job.imageStr, err)
+		} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to rewind override image archive")
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeReaderToArchive(archive, archiveMu, f, fi.Size(), job)
+}
+
+// useStreamingImageWriter opts into the go-containerregistry-based image
+// writer (BUNDLE_STREAMING_IMAGE_WRITER=1) instead of the default
+// containers/image + docker-archive path. It's a feature flag rather than a
+// replacement while the streaming writer stabilizes.
+func useStreamingImageWriter() bool {
+	v := os.Getenv("BUNDLE_STREAMING_IMAGE_WRITER")
+	return v == "1" || v == "true"
+}
+
+// authnForImage adapts a parsed X-Registry-Auth entry to go-containerregistry's
+// authn.Authenticator, falling back to anonymous access when no entry
+// matches the image's registry host.
+func authnForImage(auths map[string]registryAuthEntry, image string) authn.Authenticator {
+	cfg, ok := registryAuthConfigForImage(auths, image)
+	if !ok {
+		return authn.Anonymous
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	})
+}
+
+// streamImageToArchive copies an image straight from its registry into the
+// outer tar.gz without ever materializing a docker-archive under /images,
+// using go-containerregistry instead of containers/image. The manifest is
+// read first purely to report an expected size (config plus layer sizes) on
+// the progress stream; the tarball itself is still assembled in memory rather
+// than a single true streaming pass, since computing the exact tar framing
+// of tarball.Write's output ahead of time (required to write the outer tar
+// header before the body) isn't exposed by that package yet.
+//
+// This is NOT yet the disk-footprint fix it sounds like: it trades the
+// per-image docker-archive file under /images for a same-size in-memory
+// bytes.Buffer holding the whole image (manifest, config, and every layer),
+// and that buffer is held concurrently by up to BUNDLE_IMAGE_CONCURRENCY
+// workers at once. Enabling BUNDLE_STREAMING_IMAGE_WRITER replaces a disk
+// pressure problem with a RAM pressure one; it does not remove the
+// O(image-size) footprint, just relocates it. Treat it as a stepping stone
+// behind its feature flag, not a resolved replacement for the
+// containers/image path, until tarball.Write (or a replacement) supports
+// writing without fully buffering first.
+func streamImageToArchive(ctx context.Context, archive *tar.Writer, archiveMu *sync.Mutex, job imageCopyJob, registryAuths map[string]registryAuthEntry, progress *progressReporter, cache *diskCache, cacheKey string) error {
+	ref, err := name.ParseReference(job.imageStr, name.WeakValidation)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing override image %q", job.imageStr)
+	}
+
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuth(authnForImage(registryAuths, job.imageStr)),
+	}
+	if job.platform != "" {
+		platformOS, arch, variant, err := parsePlatform(job.platform)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing platform %q for image %s", job.platform, job.imageStr)
+		}
+		opts = append(opts, remote.WithPlatform(v1.Platform{OS: platformOS, Architecture: arch, Variant: variant}))
+	}
+
+	progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr})
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr, Error: err.Error()})
+		return errors.Wrapf(err, "failed to fetch remote image %s", job.imageStr)
+	}
+
+	if manifest, err := img.Manifest(); err == nil {
+		total := manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			total += layer.Size
+		}
+		progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr, ProgressDetail: &progressDetail{Total: total}})
+	}
+
+	var buf bytes.Buffer
+	if err := tarball.Write(ref, img, &buf); err != nil {
+		progress.emit(progressEvent{Status: "Pulling image", ID: job.imageStr, Error: err.Error()})
+		return errors.Wrapf(err, "failed to write tarball for %s", job.imageStr)
+	}
+	progress.emit(progressEvent{Status: "Pull complete", ID: job.imageStr})
+
+	if cache != nil && cacheKey != "" {
+		if _, err := cache.Put(cacheKey, bytes.NewReader(buf.Bytes()), "", ""); err != nil {
+			log.Printf("warning: failed to populate image cache for %s: %v", job.imageStr, err)
+		}
+	}
+
+	return writeReaderToArchive(archive, archiveMu, &buf, int64(buf.Len()), job)
+}
+
+// resolveImageDigest resolves job's manifest digest by fetching the manifest
+// with a GET (remote.Get, not a HEAD request), following a multi-arch index
+// down to the platform-specific manifest, so it can be used as a stable,
+// content-addressable cache key without pulling any layers.
+func resolveImageDigest(ctx context.Context, job imageCopyJob, registryAuths map[string]registryAuthEntry) (string, error) {
+	ref, err := name.ParseReference(job.imageStr, name.WeakValidation)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing image %q", job.imageStr)
+	}
+
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuth(authnForImage(registryAuths, job.imageStr)),
+	}
+	if job.platform != "" {
+		platformOS, arch, variant, err := parsePlatform(job.platform)
+		if err != nil {
+			return "", errors.Wrapf(err, "error parsing platform %q for image %s", job.platform, job.imageStr)
+		}
+		opts = append(opts, remote.WithPlatform(v1.Platform{OS: platformOS, Architecture: arch, Variant: variant}))
+	}
+
+	// remote.Head always returns the digest of the raw reference as-is (the
+	// manifest list/index digest for a multi-arch image), ignoring
+	// WithPlatform, so every platform of the same image would collide on the
+	// same cache key. Resolve through remote.Get+Descriptor.Image instead,
+	// which follows a multi-arch index down to the platform-specific child
+	// manifest, so each platform resolves to its own digest.
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return "", errors.Wrapf(err, "error resolving manifest digest for %s", job.imageStr)
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return "", errors.Wrapf(err, "error resolving platform-specific manifest for %s", job.imageStr)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", errors.Wrapf(err, "error computing manifest digest for %s", job.imageStr)
+	}
+	return digest.String(), nil
+}
+
+// runImageCopyJob copies a single image-platform job into archive, serving
+// it from imageCache when the resolved manifest digest is already cached
+// and populating the cache on a miss. Digest resolution failures fall back
+// to an uncached copy rather than failing the whole bundle.
+func runImageCopyJob(ctx context.Context, archive *tar.Writer, archiveMu *sync.Mutex, job imageCopyJob, registryAuths map[string]registryAuthEntry, progress *progressReporter, streaming bool, diskReserve uint64, cache *diskCache) error {
+	var cacheKey string
+	if cache != nil {
+		if digest, err := resolveImageDigest(ctx, job, registryAuths); err != nil {
+			log.Printf("warning: cache digest resolution failed for %s: %v", job.imageStr, err)
+		} else {
+			cacheKey = "image-" + sanitizeCacheKey(digest)
+			if entry, rc, err := cache.Get(cacheKey); err != nil {
+				log.Printf("warning: image cache lookup failed for %s: %v", job.imageStr, err)
+			} else if rc != nil {
+				defer rc.Close()
+				progress.emit(progressEvent{Status: "Using cached image", ID: job.imageStr})
+				return writeReaderToArchive(archive, archiveMu, rc, entry.size, job)
+			}
+		}
+	}
+
+	if streaming {
+		return streamImageToArchive(ctx, archive, archiveMu, job, registryAuths, progress, cache, cacheKey)
+	}
+
+	if err := waitForDiskSpace(ctx, "/images", diskReserve); err != nil {
+		return errors.Wrapf(err, "disk space guard before copying %s", job.imageStr)
+	}
+	tempDir, destPath, err := copyImageToTempDir(ctx, job, registryAuths, progress)
+	if err != nil {
+		return err
+	}
+	if err := writeImageOverrideToArchive(archive, archiveMu, tempDir, destPath, job, cache, cacheKey); err != nil {
+		return err
+	}
+	runtime.GC()
+	return nil
+}
+
 func allowRegistry(image string) bool {
 	parsed, err := url.Parse(fmt.Sprintf("https://%s", image))
 	if err != nil {
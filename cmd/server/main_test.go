@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func TestWantsProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{"query param", "/bundle/abc?progress=1", true},
+		{"accept header", "/bundle/abc", true},
+		{"plain request", "/bundle/abc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.name == "accept header" {
+				r.Header.Set("Accept", "text/plain, application/x-ndjson")
+			}
+			if got := wantsProgress(r); got != tt.want {
+				t.Errorf("wantsProgress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMultipartProgressThenArchive guards against the bug where the archive
+// part was created (and thus finalized the progress part) before any
+// progress events were written. It exercises the same ordering bundle()
+// uses: open the progress part and write to it across multiple calls, then
+// only create the archive part once the progress writes are done.
+func TestMultipartProgressThenArchive(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	progressPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/x-ndjson"}})
+	if err != nil {
+		t.Fatalf("CreatePart(progress): %v", err)
+	}
+	progress := newProgressReporter(progressPart)
+
+	progress.emit(progressEvent{Status: "step one"})
+	progress.emit(progressEvent{Status: "step two"})
+
+	archivePart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/gzip"}})
+	if err != nil {
+		t.Fatalf("CreatePart(archive): %v", err)
+	}
+	if _, err := archivePart.Write([]byte("fake archive bytes")); err != nil {
+		t.Fatalf("writing archive part: %v", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		t.Fatalf("mw.Close(): %v", err)
+	}
+
+	_, params, err := mime.ParseMediaType("multipart/mixed; boundary=" + mw.Boundary())
+	if err != nil {
+		t.Fatalf("ParseMediaType: %v", err)
+	}
+	mr := multipart.NewReader(&buf, params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading progress part: %v", err)
+	}
+	got, err := ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatalf("reading progress part body: %v", err)
+	}
+	if want := "{\"status\":\"step one\"}\n{\"status\":\"step two\"}\n"; string(got) != want {
+		t.Errorf("progress part = %q, want %q", got, want)
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading archive part: %v", err)
+	}
+	got, err = ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatalf("reading archive part body: %v", err)
+	}
+	if string(got) != "fake archive bytes" {
+		t.Errorf("archive part = %q, want %q", got, "fake archive bytes")
+	}
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache-*")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newDiskCache(dir, 15)
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+
+	put := func(key, contents string) {
+		t.Helper()
+		if _, err := c.Put(key, strings.NewReader(contents), "", ""); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	get := func(key string) bool {
+		t.Helper()
+		_, rc, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if rc == nil {
+			return false
+		}
+		rc.Close()
+		return true
+	}
+
+	put("a", "aaaaa") // 5 bytes
+	put("b", "bbbbb") // 5 bytes, total 10
+	get("a")          // "a" is now the most recently used
+	put("c", "ccccc") // 5 bytes, total 15: at budget, no eviction yet
+	put("d", "ddddd") // pushes total to 20, must evict until <= 15
+
+	if get("b") {
+		t.Error("expected least-recently-used entry \"b\" to have been evicted")
+	}
+	if !get("a") {
+		t.Error("expected recently-used entry \"a\" to survive eviction")
+	}
+	if !get("c") || !get("d") {
+		t.Error("expected most-recently-written entries to survive eviction")
+	}
+
+	stats := c.Stats()
+	if stats.TotalBytes > 15 {
+		t.Errorf("cache total bytes %d exceeds budget 15", stats.TotalBytes)
+	}
+}
+
+func TestRequireCacheAdminToken(t *testing.T) {
+	t.Setenv("BUNDLE_CACHE_ADMIN_TOKEN", "s3cret")
+
+	ok := httptest.NewRequest("POST", "/cache/purge", nil)
+	ok.Header.Set("X-Admin-Token", "s3cret")
+	if w := httptest.NewRecorder(); !requireCacheAdminToken(w, ok) {
+		t.Error("expected matching token to be accepted")
+	}
+
+	bad := httptest.NewRequest("POST", "/cache/purge", nil)
+	bad.Header.Set("X-Admin-Token", "wrong")
+	if w := httptest.NewRecorder(); requireCacheAdminToken(w, bad) {
+		t.Error("expected mismatched token to be rejected")
+	}
+
+	none := httptest.NewRequest("POST", "/cache/purge", nil)
+	if w := httptest.NewRecorder(); requireCacheAdminToken(w, none) {
+		t.Error("expected missing token to be rejected")
+	}
+}
+
+func TestRequireCacheAdminTokenDisabledWhenUnconfigured(t *testing.T) {
+	t.Setenv("BUNDLE_CACHE_ADMIN_TOKEN", "")
+
+	r := httptest.NewRequest("POST", "/cache/purge", nil)
+	r.Header.Set("X-Admin-Token", "anything")
+	if w := httptest.NewRecorder(); requireCacheAdminToken(w, r) {
+		t.Error("expected cache admin routes to stay locked down when no token is configured")
+	}
+}
+
+func TestRegistryHostForImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"ubuntu", "docker.io"},
+		{"ubuntu:latest", "docker.io"},
+		{"myorg/myimage:tag", "docker.io"},
+		{"index.docker.io/myorg/myimage:tag", "index.docker.io"},
+		{"localhost/myimage:tag", "localhost"},
+		{"localhost:5000/myimage:tag", "localhost:5000"},
+		{"gcr.io/myproject/myimage:tag", "gcr.io"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/myimage:tag", "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{"ghcr.io/myorg/myimage@sha256:abcd", "ghcr.io"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := registryHostForImage(tt.image); got != tt.want {
+				t.Errorf("registryHostForImage(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthConfigForImageUnqualifiedDockerHub(t *testing.T) {
+	auths := map[string]registryAuthEntry{
+		"index.docker.io": {Username: "me", Password: "secret"},
+	}
+
+	cfg, ok := registryAuthConfigForImage(auths, "myorg/myimage:tag")
+	if !ok {
+		t.Fatal("expected an unqualified Docker Hub reference to match the index.docker.io entry")
+	}
+	if cfg.Username != "me" || cfg.Password != "secret" {
+		t.Errorf("got %+v, want username=me password=secret", cfg)
+	}
+
+	if _, ok := registryAuthConfigForImage(auths, "gcr.io/myproject/myimage:tag"); ok {
+		t.Error("expected no match for a different registry host")
+	}
+}
+
+func TestPlatformsForImage(t *testing.T) {
+	tests := []struct {
+		name            string
+		image           ImageRef
+		bundlePlatforms []string
+		want            []string
+	}{
+		{"pinned platform wins", ImageRef{Platform: "linux/arm64"}, []string{"linux/amd64"}, []string{"linux/arm64"}},
+		{"fans out over bundle platforms", ImageRef{}, []string{"linux/amd64", "linux/arm64"}, []string{"linux/amd64", "linux/arm64"}},
+		{"defaults to daemon's choice", ImageRef{}, nil, []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := platformsForImage(tt.image, tt.bundlePlatforms)
+			if len(got) != len(tt.want) {
+				t.Fatalf("platformsForImage() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("platformsForImage()[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestImageOverrideName(t *testing.T) {
+	tests := []struct {
+		idx      int
+		platform string
+		want     string
+	}{
+		{0, "", "kurl/image-overrides/0.tar"},
+		{1, "linux/amd64", "kurl/image-overrides/1-linux-amd64.tar"},
+		{2, "linux/arm/v7", "kurl/image-overrides/2-linux-arm-v7.tar"},
+		{3, "not-a-platform", "kurl/image-overrides/3.tar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := imageOverrideName(tt.idx, tt.platform); got != tt.want {
+				t.Errorf("imageOverrideName(%d, %q) = %q, want %q", tt.idx, tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegistryAuth(t *testing.T) {
+	encode := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(raw)
+	}
+
+	single := encode(registryAuthEntry{Username: "me", Password: "secret", ServerAddress: "https://index.docker.io/v1/"})
+	byHost := encode(map[string]registryAuthEntry{
+		"gcr.io": {Username: "gcruser", Password: "gcrpass"},
+	})
+
+	auths := parseRegistryAuth(single + "," + byHost)
+
+	if cfg, ok := auths["index.docker.io"]; !ok || cfg.Username != "me" || cfg.Password != "secret" {
+		t.Errorf("index.docker.io entry = %+v, ok=%v, want username=me password=secret", cfg, ok)
+	}
+	if cfg, ok := auths["gcr.io"]; !ok || cfg.Username != "gcruser" || cfg.Password != "gcrpass" {
+		t.Errorf("gcr.io entry = %+v, ok=%v, want username=gcruser password=gcrpass", cfg, ok)
+	}
+
+	if got := parseRegistryAuth(""); len(got) != 0 {
+		t.Errorf("parseRegistryAuth(\"\") = %v, want empty map", got)
+	}
+
+	// A malformed entry shouldn't fail the whole header.
+	got := parseRegistryAuth("not-valid-base64!!!," + single)
+	if cfg, ok := got["index.docker.io"]; !ok || cfg.Username != "me" {
+		t.Errorf("expected the valid entry to still parse alongside a malformed one, got %+v ok=%v", cfg, ok)
+	}
+}
+
+func TestAuthnForImageThreadsRegistryToken(t *testing.T) {
+	auths := map[string]registryAuthEntry{
+		"ghcr.io": {RegistryToken: "bearer-token-value"},
+	}
+
+	cfg, err := authn.Authorization(context.Background(), authnForImage(auths, "ghcr.io/myorg/myimage:tag"))
+	if err != nil {
+		t.Fatalf("Authorization: %v", err)
+	}
+	if cfg.RegistryToken != "bearer-token-value" {
+		t.Errorf("RegistryToken = %q, want %q", cfg.RegistryToken, "bearer-token-value")
+	}
+
+	anon := authnForImage(auths, "gcr.io/other/image:tag")
+	if anon != authn.Anonymous {
+		t.Errorf("expected anonymous authenticator for a host with no matching entry")
+	}
+}